@@ -0,0 +1,21 @@
+package config
+
+// ShortNameResolutionConfig is the raw, JSON-decoded shape of the
+// short-name resolution fields of daemon.json:
+//
+//	{
+//	  "short-name-resolution": "enforcing",
+//	  "unqualified-search-registries": ["docker.io"],
+//	  "short-name-aliases": {"nginx": "docker.io/library/nginx"}
+//	}
+//
+// It is meant to be converted into a containerd.ShortNameConfig (via
+// ShortNameConfigFromRaw, in daemon/containerd) once the daemon's
+// ImageService has been constructed, so this package doesn't need to
+// depend on daemon/containerd itself. Daemon start-up doesn't parse or
+// apply this yet; see ShortNameConfigFromRaw's doc comment.
+type ShortNameResolutionConfig struct {
+	Mode                        string            `json:"short-name-resolution,omitempty"`
+	UnqualifiedSearchRegistries []string          `json:"unqualified-search-registries,omitempty"`
+	Aliases                     map[string]string `json:"short-name-aliases,omitempty"`
+}
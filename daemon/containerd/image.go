@@ -132,6 +132,14 @@ func (i *ImageService) getImage(ctx context.Context, refOrID string, platform *o
 // reference or identifier. Returns the descriptor of
 // the image, could be manifest list, manifest, or config.
 func (i *ImageService) resolveImage(ctx context.Context, refOrID string, platform *ocispec.Platform) (img containerdimages.Image, err error) {
+	if !shortID.MatchString(refOrID) {
+		resolved, _, err := i.ResolveShortName(refOrID)
+		if err != nil {
+			return containerdimages.Image{}, err
+		}
+		refOrID = resolved
+	}
+
 	parsed, err := reference.ParseAnyReference(refOrID)
 	if err != nil {
 		return containerdimages.Image{}, errdefs.InvalidParameter(err)
@@ -3,54 +3,289 @@ package containerd
 import (
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/containerd/containerd/mount"
+	"github.com/containerd/continuity/fs"
 	"github.com/docker/docker/container"
 	"github.com/docker/docker/oci"
 	"github.com/docker/docker/pkg/archive"
 	"github.com/google/uuid"
 	"github.com/opencontainers/image-spec/identity"
+	"golang.org/x/sys/unix"
 )
 
+// overlayOpaqueXattr is the xattr overlayfs sets on a directory in the
+// upper layer to mark it as "opaque": its contents fully replace the
+// same-named directory in the lower layers, rather than being merged with it.
+const overlayOpaqueXattr = "trusted.overlay.opaque"
+
+// Changes returns a list of changes between the container's filesystem and
+// the image it is based on.
 func (i *ImageService) Changes(ctx context.Context, container *container.Container) (changes []archive.Change, err error) {
 	snapshotter := i.client.SnapshotService(i.snapshotter)
-	mounts, uerr := snapshotter.Mounts(ctx, container.ID)
+	mounts, err := snapshotter.Mounts(ctx, container.ID)
 	if err != nil {
-		return nil, uerr
+		return nil, err
 	}
 
-	platform := container.Config.Platform
-	baseImg, _, uerr := i.getImage(ctx, container.Config.Image, &platform)
-	if uerr != nil {
-		return nil, uerr
+	if isOverlaySnapshotter(i.snapshotter) {
+		if upper, lowers, ok := overlayDirs(mounts); ok {
+			return changesFromOverlayUpper(upper, lowers)
+		}
+		// Not a (fully set up) overlay mount, e.g. a single read-only
+		// lower with no upper yet: nothing has changed.
 	}
-	diffIDs, uerr := baseImg.RootFS(ctx)
-	if uerr != nil {
-		return nil, uerr
+
+	return i.changesViaMount(ctx, container, mounts)
+}
+
+// changesFromOverlayUpper computes changes by walking only the overlay
+// upper directory, translating whiteout char devices directly into
+// archive.ChangeDelete and opaque directories into a delete of the
+// directory, an add for each of its present children, and a delete for
+// every entry the corresponding lower directories had that the opaque
+// upper copy didn't recreate. This avoids mounting the container's rootfs
+// or a parent view at all: the overlay upper dir already encodes exactly
+// what changed, and the lower dirs are already present on disk (as other
+// snapshots), so membership in a lower layer can be checked with a plain
+// stat.
+func changesFromOverlayUpper(upperRoot string, lowerRoots []string) ([]archive.Change, error) {
+	var changes []archive.Change
+
+	err := filepath.Walk(upperRoot, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == upperRoot {
+			return nil
+		}
+		rel, err := filepath.Rel(upperRoot, path)
+		if err != nil {
+			return err
+		}
+
+		if isOverlayWhiteout(fi) {
+			changes = append(changes, archive.Change{Path: rel, Kind: archive.ChangeDelete})
+			return nil
+		}
+
+		if fi.IsDir() && isOverlayOpaque(path) {
+			changes = append(changes, archive.Change{Path: rel, Kind: archive.ChangeDelete})
+			if err := addOpaqueDirChildren(path, upperRoot, &changes); err != nil {
+				return err
+			}
+			if err := addOpaqueDirDeletions(rel, path, lowerRoots, &changes); err != nil {
+				return err
+			}
+			// addOpaqueDirChildren already walked this subtree itself; skip
+			// it here or every child would be recorded twice.
+			return filepath.SkipDir
+		}
+
+		if existsInAny(rel, lowerRoots) {
+			changes = append(changes, archive.Change{Path: rel, Kind: archive.ChangeModify})
+		} else {
+			changes = append(changes, archive.Change{Path: rel, Kind: archive.ChangeAdd})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff overlay upperdir %s: %w", upperRoot, err)
 	}
-	rnd, uerr := uuid.NewRandom()
-	if uerr != nil {
-		return nil, uerr
+	return changes, nil
+}
+
+// addOpaqueDirChildren records every entry beneath dir (which lives in the
+// upper layer and has already been recorded as deleted) as an add, since an
+// opaque directory's contents fully replace whatever the lower layers had.
+func addOpaqueDirChildren(dir, upperRoot string, changes *[]archive.Change) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(upperRoot, path)
+		if err != nil {
+			return err
+		}
+		if isOverlayWhiteout(fi) {
+			// A lower entry deliberately excluded from the opaque
+			// directory's contents; nothing to add.
+			return nil
+		}
+		*changes = append(*changes, archive.Change{Path: rel, Kind: archive.ChangeAdd})
+		return nil
+	})
+}
+
+// addOpaqueDirDeletions records a ChangeDelete for every entry that existed
+// beneath rel in any of lowerRoots (i.e. before the directory at rel became
+// opaque) but isn't also present in upperDir, its current upper copy.
+// Without this, a file the lower layers had that the opaque directory
+// doesn't recreate would never be reported as changed at all: the
+// directory's own top-level delete only tells a reader that the directory
+// was replaced, not what it used to contain.
+func addOpaqueDirDeletions(rel, upperDir string, lowerRoots []string, changes *[]archive.Change) error {
+	seen := make(map[string]bool)
+	for _, lowerRoot := range lowerRoots {
+		lowerDir := filepath.Join(lowerRoot, rel)
+		err := filepath.Walk(lowerDir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					// This lower layer never had a directory at rel.
+					return nil
+				}
+				return err
+			}
+			if path == lowerDir {
+				return nil
+			}
+			childRel, err := filepath.Rel(lowerDir, path)
+			if err != nil {
+				return err
+			}
+			if seen[childRel] {
+				// Already decided (found in an earlier, shadowing
+				// lowerdir, or already recorded as deleted).
+				return nil
+			}
+			seen[childRel] = true
+			if _, err := os.Lstat(filepath.Join(upperDir, childRel)); err == nil {
+				// Recreated in the opaque directory's upper copy.
+				return nil
+			}
+			*changes = append(*changes, archive.Change{Path: filepath.Join(rel, childRel), Kind: archive.ChangeDelete})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
 	}
-	parent, uerr := snapshotter.View(ctx, rnd.String(), identity.ChainID(diffIDs).String())
-	if uerr != nil {
-		return nil, uerr
+	return nil
+}
+
+// changesViaMount is the fallback used for non-overlay snapshotters: it
+// mounts both the container rootfs and a fresh parent view, then does a
+// metadata-only diff via continuity/fs.Changes, which compares inode
+// metadata (mtime, size, mode, ownership) rather than Docker's legacy
+// recursive stat-walk.
+func (i *ImageService) changesViaMount(ctx context.Context, c *container.Container, mounts []mount.Mount) (changes []archive.Change, err error) {
+	snapshotter := i.client.SnapshotService(i.snapshotter)
+
+	platform := c.Config.Platform
+	baseImg, _, err := i.getImage(ctx, c.Config.Image, &platform)
+	if err != nil {
+		return nil, err
+	}
+	diffIDs, err := baseImg.RootFS(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rnd, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	parent, err := snapshotter.View(ctx, rnd.String(), identity.ChainID(diffIDs).String())
+	if err != nil {
+		return nil, err
 	}
 	defer func() {
-		uerr = snapshotter.Remove(ctx, rnd.String())
+		uerr := snapshotter.Remove(ctx, rnd.String())
 		if err == nil {
 			err = uerr
-		} else {
+		} else if uerr != nil {
 			err = fmt.Errorf("%s: %w", uerr.Error(), err)
 		}
 	}()
 
-	err = mount.WithTempMount(ctx, oci.ReadonlyMounts(mounts), func(fs string) error {
-		return mount.WithTempMount(ctx, parent, func(root string) error {
-			changes, err = archive.ChangesDirs(fs, root)
-			return err
+	err = mount.WithTempMount(ctx, oci.ReadonlyMounts(mounts), func(upperRoot string) error {
+		return mount.WithTempMount(ctx, parent, func(parentRoot string) error {
+			return fs.Changes(ctx, parentRoot, upperRoot, func(kind fs.ChangeKind, path string, _ os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				changes = append(changes, archive.Change{Path: path, Kind: adaptChangeKind(kind)})
+				return nil
+			})
 		})
 	})
 
 	return changes, err
 }
+
+// adaptChangeKind translates continuity/fs's ChangeKind into the
+// archive.Change enum used throughout the rest of the daemon.
+func adaptChangeKind(kind fs.ChangeKind) archive.ChangeType {
+	switch kind {
+	case fs.ChangeKindAdd:
+		return archive.ChangeAdd
+	case fs.ChangeKindDelete:
+		return archive.ChangeDelete
+	default:
+		return archive.ChangeModify
+	}
+}
+
+// isOverlaySnapshotter reports whether name identifies an overlay-family
+// snapshotter, for which changes can be computed from the upper dir and the
+// lower dirs already on disk, without mounting anything.
+func isOverlaySnapshotter(name string) bool {
+	switch name {
+	case "overlayfs", "overlay", "overlay2":
+		return true
+	default:
+		return false
+	}
+}
+
+// overlayDirs extracts the upperdir and lowerdir entries from an overlay
+// mount, returning ok=false if mounts isn't a fully set up overlay mount
+// (e.g. it is a plain bind mount of a single read-only lower).
+func overlayDirs(mounts []mount.Mount) (upper string, lowers []string, ok bool) {
+	for _, m := range mounts {
+		if m.Type != "overlay" {
+			continue
+		}
+		for _, opt := range m.Options {
+			switch {
+			case strings.HasPrefix(opt, "upperdir="):
+				upper = strings.TrimPrefix(opt, "upperdir=")
+			case strings.HasPrefix(opt, "lowerdir="):
+				lowers = strings.Split(strings.TrimPrefix(opt, "lowerdir="), ":")
+			}
+		}
+		return upper, lowers, upper != ""
+	}
+	return "", nil, false
+}
+
+// isOverlayWhiteout reports whether fi describes an overlayfs whiteout
+// marker: a character device with major/minor number 0/0.
+func isOverlayWhiteout(fi os.FileInfo) bool {
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := fi.Sys().(*unix.Stat_t)
+	return ok && unix.Major(uint64(stat.Rdev)) == 0 && unix.Minor(uint64(stat.Rdev)) == 0
+}
+
+// isOverlayOpaque reports whether the directory at path is marked opaque.
+func isOverlayOpaque(path string) bool {
+	_, err := unix.Getxattr(path, overlayOpaqueXattr, nil)
+	return err == nil
+}
+
+// existsInAny reports whether rel exists under any of roots.
+func existsInAny(rel string, roots []string) bool {
+	for _, root := range roots {
+		if _, err := os.Lstat(filepath.Join(root, rel)); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+package containerd
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/docker/docker/pkg/archive"
+	"golang.org/x/sys/unix"
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestOverlayDirs(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		mounts     []mount.Mount
+		wantUpper  string
+		wantLowers []string
+		wantOK     bool
+	}{
+		{
+			name: "fully set up overlay",
+			mounts: []mount.Mount{
+				{Type: "overlay", Options: []string{"index=off", "upperdir=/upper", "lowerdir=/lower1:/lower2", "workdir=/work"}},
+			},
+			wantUpper:  "/upper",
+			wantLowers: []string{"/lower1", "/lower2"},
+			wantOK:     true,
+		},
+		{
+			name: "single read-only lower, no upper yet",
+			mounts: []mount.Mount{
+				{Type: "bind", Options: []string{"ro"}},
+			},
+			wantOK: false,
+		},
+		{
+			name: "overlay mount missing upperdir",
+			mounts: []mount.Mount{
+				{Type: "overlay", Options: []string{"lowerdir=/lower1"}},
+			},
+			wantOK: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upper, lowers, ok := overlayDirs(tc.mounts)
+			assert.Check(t, is.Equal(ok, tc.wantOK))
+			if tc.wantOK {
+				assert.Check(t, is.Equal(upper, tc.wantUpper))
+				assert.Check(t, is.DeepEqual(lowers, tc.wantLowers))
+			}
+		})
+	}
+}
+
+func TestIsOverlayWhiteout(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("overlayfs whiteouts are a Linux-only concept")
+	}
+	if os.Getuid() != 0 {
+		t.Skip("creating a whiteout device node requires root")
+	}
+
+	dir := t.TempDir()
+
+	whiteout := filepath.Join(dir, "whiteout")
+	if err := unix.Mknod(whiteout, unix.S_IFCHR|0o600, 0); err != nil {
+		t.Skipf("mknod not permitted in this environment: %v", err)
+	}
+	fi, err := os.Lstat(whiteout)
+	assert.NilError(t, err)
+	assert.Check(t, isOverlayWhiteout(fi))
+
+	regular := filepath.Join(dir, "regular")
+	assert.NilError(t, os.WriteFile(regular, nil, 0o644))
+	fi, err = os.Lstat(regular)
+	assert.NilError(t, err)
+	assert.Check(t, !isOverlayWhiteout(fi))
+}
+
+// sortChanges returns changes sorted by path so assertions don't depend on
+// filepath.Walk's traversal order.
+func sortChanges(changes []archive.Change) []archive.Change {
+	sort.Slice(changes, func(a, b int) bool { return changes[a].Path < changes[b].Path })
+	return changes
+}
+
+func TestChangesFromOverlayUpper(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("overlayfs whiteouts/opaque dirs are a Linux-only concept")
+	}
+	if os.Getuid() != 0 {
+		t.Skip("marking a directory opaque requires root (trusted.* xattr)")
+	}
+
+	lower := t.TempDir()
+	upper := t.TempDir()
+
+	// Rewritten in the upper layer: existing.txt is present in both, so
+	// it's a modify.
+	assert.NilError(t, os.WriteFile(filepath.Join(lower, "existing.txt"), []byte("old"), 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(upper, "existing.txt"), []byte("new"), 0o644))
+
+	// A brand new file only present in the upper layer.
+	assert.NilError(t, os.WriteFile(filepath.Join(upper, "added.txt"), []byte("new"), 0o644))
+
+	// A whiteout recording the deletion of something from the lower layer.
+	assert.NilError(t, unix.Mknod(filepath.Join(upper, "deleted"), unix.S_IFCHR|0o600, 0))
+
+	// An opaque directory: its presence in the upper layer fully replaces
+	// the same-named lower directory, so it should appear as a delete of
+	// the directory itself plus an add for each of its children, and its
+	// children must not also be visited by the outer walk. old.txt existed
+	// in the lower copy but isn't recreated in the opaque upper copy (the
+	// common case: rm -rf /x && mkdir /x && touch /x/new), so it must be
+	// reported as an explicit delete of its own, not silently dropped.
+	assert.NilError(t, os.Mkdir(filepath.Join(lower, "opaque"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(lower, "opaque", "old.txt"), []byte("old"), 0o644))
+	assert.NilError(t, os.Mkdir(filepath.Join(upper, "opaque"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(upper, "opaque", "child.txt"), []byte("new"), 0o644))
+	if err := unix.Setxattr(filepath.Join(upper, "opaque"), overlayOpaqueXattr, []byte("y"), 0); err != nil {
+		t.Skipf("setting trusted.overlay.opaque xattr not permitted in this environment: %v", err)
+	}
+
+	changes, err := changesFromOverlayUpper(upper, []string{lower})
+	assert.NilError(t, err)
+
+	assert.DeepEqual(t, sortChanges(changes), []archive.Change{
+		{Path: "added.txt", Kind: archive.ChangeAdd},
+		{Path: "deleted", Kind: archive.ChangeDelete},
+		{Path: "existing.txt", Kind: archive.ChangeModify},
+		{Path: "opaque", Kind: archive.ChangeDelete},
+		{Path: filepath.Join("opaque", "child.txt"), Kind: archive.ChangeAdd},
+		{Path: filepath.Join("opaque", "old.txt"), Kind: archive.ChangeDelete},
+	})
+}
+
+func TestAddOpaqueDirDeletions(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("overlayfs opaque dirs are a Linux-only concept")
+	}
+
+	lower1 := t.TempDir()
+	lower2 := t.TempDir()
+	upper := t.TempDir()
+
+	// Only in lower1, not recreated in upper: must be reported deleted.
+	assert.NilError(t, os.Mkdir(filepath.Join(lower1, "opaque"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(lower1, "opaque", "gone.txt"), nil, 0o644))
+
+	// In lower2 (a lower layer shadowed by lower1 for this dir, since
+	// overlayfs's lowerdir is itself an ordered stack), also not recreated.
+	assert.NilError(t, os.Mkdir(filepath.Join(lower2, "opaque"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(lower2, "opaque", "also-gone.txt"), nil, 0o644))
+
+	// Present in a lower layer and recreated in upper: not a deletion.
+	assert.NilError(t, os.WriteFile(filepath.Join(lower1, "opaque", "kept.txt"), nil, 0o644))
+
+	opaqueUpper := filepath.Join(upper, "opaque")
+	assert.NilError(t, os.Mkdir(opaqueUpper, 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(opaqueUpper, "kept.txt"), nil, 0o644))
+
+	var changes []archive.Change
+	assert.NilError(t, addOpaqueDirDeletions("opaque", opaqueUpper, []string{lower1, lower2}, &changes))
+
+	assert.DeepEqual(t, sortChanges(changes), []archive.Change{
+		{Path: filepath.Join("opaque", "also-gone.txt"), Kind: archive.ChangeDelete},
+		{Path: filepath.Join("opaque", "gone.txt"), Kind: archive.ChangeDelete},
+	})
+}
+
+func TestAddOpaqueDirChildren(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("overlayfs whiteouts are a Linux-only concept")
+	}
+	if os.Getuid() != 0 {
+		t.Skip("creating a whiteout device node requires root")
+	}
+
+	upper := t.TempDir()
+	dir := filepath.Join(upper, "opaque")
+	assert.NilError(t, os.Mkdir(dir, 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "kept.txt"), nil, 0o644))
+	// An entry deliberately excluded from the opaque directory's
+	// contents: it must not be recorded as an add.
+	assert.NilError(t, unix.Mknod(filepath.Join(dir, "excluded"), unix.S_IFCHR|0o600, 0))
+
+	var changes []archive.Change
+	assert.NilError(t, addOpaqueDirChildren(dir, upper, &changes))
+
+	assert.DeepEqual(t, sortChanges(changes), []archive.Change{
+		{Path: filepath.Join("opaque", "kept.txt"), Kind: archive.ChangeAdd},
+	})
+}
@@ -0,0 +1,191 @@
+package containerd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd"
+	containerdimages "github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// ImageTreeOptions controls ImageTree.
+type ImageTreeOptions struct {
+	// Platform restricts the tree to the rootfs matching this platform,
+	// when the queried reference is a manifest list.
+	Platform *ocispec.Platform
+}
+
+// LayerNode describes one layer of an image's chain: its on-disk identity,
+// and the other locally stored images that share it.
+type LayerNode struct {
+	ChainID   digest.Digest
+	DiffID    digest.Digest
+	MediaType string
+	// Size is the on-disk size of this layer, as reported by the
+	// snapshotter, or 0 if the layer isn't present locally.
+	Size int64
+	// SharedBy lists references of other images whose rootfs contains this
+	// layer, i.e. this layer's chain ID is a prefix of theirs.
+	SharedBy []string
+}
+
+// ImageTree describes an image's layer chain, and how it relates to every
+// other image in the local store: which images share which of its layers,
+// and which images were built FROM it.
+type ImageTree struct {
+	Ref    string
+	Layers []LayerNode
+	// Children are references of images whose rootfs is a strict extension
+	// of this image's rootfs, i.e. images that were built FROM this one.
+	Children []string
+}
+
+// ImageTree walks containerdimages.List and the snapshotter to describe
+// refOrID's layer chain, one LayerNode per chain ID in order, and every other
+// locally stored image that shares a prefix of it or extends it. The result
+// is a flat list of refOrID's own layers, not a graph of all local images:
+// layers that only other images have are not included. This turns
+// isRootfsChildOf into a user-facing feature, comparable to
+// `podman image tree`.
+func (i *ImageService) ImageTree(ctx context.Context, refOrID string, opts ImageTreeOptions) (*ImageTree, error) {
+	target, err := i.resolveImage(ctx, refOrID, opts.Platform)
+	if err != nil {
+		return nil, err
+	}
+
+	targetRoot, layerMediaTypes, err := i.imageRootFS(ctx, target, opts.Platform)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read rootfs of %q", refOrID)
+	}
+
+	all, err := i.client.ImageService().List(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list images")
+	}
+
+	type node struct {
+		ref    string
+		rootfs ocispec.RootFS
+	}
+	var others []node
+	for _, img := range all {
+		if img.Target.Digest == target.Target.Digest {
+			continue
+		}
+		rootfs, _, err := i.imageRootFS(ctx, img, opts.Platform)
+		if err != nil {
+			// Not unpacked, or doesn't support the requested platform;
+			// simply excluded from the tree.
+			continue
+		}
+		others = append(others, node{ref: img.Name, rootfs: rootfs})
+	}
+
+	tree := &ImageTree{Ref: target.Name}
+
+	snapshotter := i.client.SnapshotService(i.snapshotter)
+	var chain []digest.Digest
+	for idx, diffID := range targetRoot.DiffIDs {
+		chain = append(chain, diffID)
+		chainID := identity.ChainID(chain)
+
+		layer := LayerNode{ChainID: chainID, DiffID: diffID}
+		if idx < len(layerMediaTypes) {
+			layer.MediaType = layerMediaTypes[idx]
+		}
+		if usage, err := snapshotter.Usage(ctx, chainID.String()); err == nil {
+			layer.Size = usage.Size
+		}
+
+		for _, other := range others {
+			if hasChainPrefix(other.rootfs, chain) {
+				layer.SharedBy = append(layer.SharedBy, other.ref)
+			}
+		}
+
+		tree.Layers = append(tree.Layers, layer)
+	}
+
+	for _, other := range others {
+		if isRootfsChildOf(other.rootfs, targetRoot) {
+			tree.Children = append(tree.Children, other.ref)
+		}
+	}
+
+	return tree, nil
+}
+
+// RenderImageTree renders tree as a simple ASCII tree, in the spirit of
+// `podman image tree`.
+func RenderImageTree(tree *ImageTree) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", tree.Ref)
+
+	for idx, layer := range tree.Layers {
+		branch := "├─"
+		if idx == len(tree.Layers)-1 {
+			branch = "└─"
+		}
+		fmt.Fprintf(&b, "%s Layer %s (%s, %d bytes)\n", branch, layer.DiffID, layer.MediaType, layer.Size)
+		for _, ref := range layer.SharedBy {
+			fmt.Fprintf(&b, "│    shared with: %s\n", ref)
+		}
+	}
+
+	for _, child := range tree.Children {
+		fmt.Fprintf(&b, "built upon by: %s\n", child)
+	}
+
+	return b.String()
+}
+
+// imageRootFS resolves img's config for platform and returns its RootFS,
+// along with the media type of each of its layers in the same order as
+// RootFS.DiffIDs.
+func (i *ImageService) imageRootFS(ctx context.Context, img containerdimages.Image, platform *ocispec.Platform) (ocispec.RootFS, []string, error) {
+	c := containerd.NewImage(i.client, img)
+	if platform != nil {
+		c = containerd.NewImageWithPlatform(i.client, img, platforms.OnlyStrict(*platform))
+	}
+
+	diffIDs, err := c.RootFS(ctx)
+	if err != nil {
+		return ocispec.RootFS{}, nil, err
+	}
+	rootfs := ocispec.RootFS{Type: "layers", DiffIDs: diffIDs}
+
+	manifest, err := containerdimages.Manifest(ctx, i.client.ContentStore(), img.Target, c.Platform())
+	if err != nil {
+		return rootfs, nil, nil
+	}
+	mediaTypes := make([]string, len(manifest.Layers))
+	for idx, l := range manifest.Layers {
+		mediaTypes[idx] = l.MediaType
+	}
+	return rootfs, mediaTypes, nil
+}
+
+// hasChainPrefix reports whether rootfs's DiffIDs begin with prefix.
+func hasChainPrefix(rootfs ocispec.RootFS, prefix []digest.Digest) bool {
+	if len(rootfs.DiffIDs) < len(prefix) {
+		return false
+	}
+	for idx, d := range prefix {
+		if rootfs.DiffIDs[idx] != d {
+			return false
+		}
+	}
+	return true
+}
+
+// isRootfsChildOf reports whether child is a child of parent, i.e. parent's
+// DiffIDs are a strict prefix of child's.
+func isRootfsChildOf(child, parent ocispec.RootFS) bool {
+	return len(child.DiffIDs) > len(parent.DiffIDs) && hasChainPrefix(child, parent.DiffIDs)
+}
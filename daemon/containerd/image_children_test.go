@@ -60,6 +60,56 @@ func FuzzIsRootfsChildOf(f *testing.F) {
 	})
 }
 
+func TestHasChainPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		rootfs ocispec.RootFS
+		prefix []digest.Digest
+		out    bool
+	}{
+		{name: "equal", rootfs: toRootfs("ABC"), prefix: toRootfs("ABC").DiffIDs, out: true},
+		{name: "rootfs extends prefix", rootfs: toRootfs("ABC"), prefix: toRootfs("AB").DiffIDs, out: true},
+		{name: "empty prefix always matches", rootfs: toRootfs("ABC"), prefix: nil, out: true},
+		{name: "prefix longer than rootfs", rootfs: toRootfs("AB"), prefix: toRootfs("ABC").DiffIDs, out: false},
+		{name: "same length, different layers", rootfs: toRootfs("ABD"), prefix: toRootfs("ABC").DiffIDs, out: false},
+		{name: "diverges partway through", rootfs: toRootfs("AXC"), prefix: toRootfs("ABC").DiffIDs, out: false},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			out := hasChainPrefix(tc.rootfs, tc.prefix)
+			assert.Check(t, is.Equal(out, tc.out))
+		})
+	}
+}
+
+func TestRenderImageTree(t *testing.T) {
+	tree := &ImageTree{
+		Ref: "docker.io/library/app:latest",
+		Layers: []LayerNode{
+			{
+				DiffID:    digest.FromString("A"),
+				MediaType: ocispec.MediaTypeImageLayerGzip,
+				Size:      1024,
+				SharedBy:  []string{"docker.io/library/base:latest"},
+			},
+			{
+				DiffID:    digest.FromString("B"),
+				MediaType: ocispec.MediaTypeImageLayerGzip,
+				Size:      2048,
+			},
+		},
+		Children: []string{"docker.io/library/app:dev"},
+	}
+
+	out := RenderImageTree(tree)
+
+	assert.Check(t, is.Contains(out, "docker.io/library/app:latest"))
+	assert.Check(t, is.Contains(out, "shared with: docker.io/library/base:latest"))
+	assert.Check(t, is.Contains(out, "built upon by: docker.io/library/app:dev"))
+	assert.Check(t, is.Contains(out, "1024 bytes"))
+	assert.Check(t, is.Contains(out, "2048 bytes"))
+}
+
 func toRootfs(values string) ocispec.RootFS {
 	dgsts := []digest.Digest{}
 
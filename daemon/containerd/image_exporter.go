@@ -1,8 +1,14 @@
 package containerd
 
 import (
+	"archive/tar"
 	"context"
 	"io"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/containerd/containerd"
 	cerrdefs "github.com/containerd/containerd/errdefs"
@@ -13,6 +19,10 @@ import (
 	"github.com/containerd/containerd/platforms"
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/container"
+	"github.com/docker/docker/daemon/events"
+	"github.com/docker/docker/pkg/progress"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/docker/pkg/streamformatter"
 	"github.com/google/uuid"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
@@ -34,8 +44,6 @@ func (i *ImageService) PerformWithBaseFS(ctx context.Context, c *container.Conta
 // stream. All images with the given tag and all versions containing
 // the same tag are exported. names is the set of tags to export, and
 // outStream is the writer which the images are written to.
-//
-// TODO(thaJeztah): produce JSON stream progress response and image events; see https://github.com/moby/moby/issues/43910
 func (i *ImageService) ExportImage(ctx context.Context, names []string, outStream io.Writer) error {
 	opts := []archive.ExportOpt{
 		archive.WithSkipNonDistributableBlobs(),
@@ -54,7 +62,12 @@ func (i *ImageService) ExportImage(ctx context.Context, names []string, outStrea
 		archive.WithPlatform(allPlatformsWithPreference(platforms.Default())),
 	}
 
+	var targets []ocispec.Descriptor
 	for _, imageRef := range names {
+		if img, err := i.resolveImage(ctx, imageRef, nil); err == nil {
+			targets = append(targets, img.Target)
+		}
+
 		newOpt, tmpImage, err := i.optForImageExport(ctx, imageRef)
 		if tmpImage != nil {
 			defer i.client.ImageService().Delete(ctx, tmpImage.Name, containerdimages.SynchronousDelete())
@@ -67,24 +80,80 @@ func (i *ImageService) ExportImage(ctx context.Context, names []string, outStrea
 		}
 	}
 
-	return i.client.Export(ctx, outStream, opts...)
+	// The archive itself is streamed straight through outStream, so progress
+	// can't be reported as JSON messages the way LoadImage does; instead we
+	// count bytes written and, as each layer's bytes clear the stream, raise
+	// an "export" event on the events bus so `docker events` (and anything
+	// watching it, such as a UI) can show real per-layer progress.
+	counted := &countingWriter{w: outStream}
+	thresholds := i.layerExportThresholds(ctx, targets...)
+
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	go i.reportExportProgress(doneCh, counted, thresholds)
+
+	if err := i.client.Export(ctx, counted, opts...); err != nil {
+		return err
+	}
+	for _, imageRef := range names {
+		i.logImageEvent(imageRef, "save")
+	}
+	return nil
 }
 
 // LoadImage uploads a set of images into the repository. This is the
 // complement of ExportImage.  The input stream is an uncompressed tar
 // ball containing images and metadata.
-//
-// TODO(thaJeztah): produce JSON stream progress response and image events; see https://github.com/moby/moby/issues/43910
 func (i *ImageService) LoadImage(ctx context.Context, inTar io.ReadCloser, outStream io.Writer, quiet bool) error {
 	platform := platforms.All
-	imgs, err := i.client.Import(ctx, inTar, containerd.WithImportPlatform(platform))
 
+	// progressOutput is written to both by the reportLoadProgress goroutine
+	// below and by the main loop's final "Loaded image" messages; wrap it so
+	// the two don't race on the underlying JSON stream encoder.
+	progressOutput := &syncProgressOutput{out: streamformatter.NewJSONProgressOutput(outStream, false)}
+
+	// Quiet short-circuits per-layer progress: skip the polling goroutine
+	// and only emit the final "Loaded image" summary lines below.
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	var importTar io.Reader = inTar
+	var pw *io.PipeWriter
+	if !quiet {
+		// The content store's ingest statuses are daemon-wide, so without
+		// scoping, reportLoadProgress would show blobs belonging to any
+		// other concurrently running load or pull too. Tee the archive
+		// through a tar scanner that records this call's own blob digests
+		// as they stream past, and filter statuses against that set.
+		digests := &importBlobDigests{}
+		var pr *io.PipeReader
+		pr, pw = io.Pipe()
+		importTar = &pipeTeeReader{r: inTar, pw: pw}
+		go func() {
+			_ = scanImportBlobDigests(pr, digests)
+		}()
+		go i.reportLoadProgress(ctx, doneCh, progressOutput, digests)
+	}
+
+	imgs, err := i.client.Import(ctx, importTar, containerd.WithImportPlatform(platform))
+	if pw != nil {
+		// Import may return without having read inTar to completion (e.g.
+		// a malformed or truncated archive): pipeTeeReader only closes pw
+		// once inTar itself is drained, so without this the scan goroutine
+		// above would block on tr.Next() forever. Closing an already
+		// -closed pw is a no-op.
+		pw.Close()
+	}
 	if err != nil {
 		// TODO(thaJeztah): remove this log or change to debug once we can; see https://github.com/moby/moby/pull/43822#discussion_r937502405
 		logrus.WithError(err).Warn("failed to import image to containerd")
 		return errors.Wrap(err, "failed to import image")
 	}
 
+	imgs, err = i.applyShortNameResolution(ctx, imgs)
+	if err != nil {
+		return err
+	}
+
 	for _, img := range imgs {
 		platformImg := containerd.NewImageWithPlatform(i.client, img, platform)
 
@@ -103,10 +172,287 @@ func (i *ImageService) LoadImage(ctx context.Context, inTar io.ReadCloser, outSt
 				return errors.Wrap(err, "failed to unpack image")
 			}
 		}
+
+		if isDanglingImage(platformImg) {
+			progress.Message(progressOutput, "", "Loaded image ID: "+img.Target.Digest.String())
+		} else {
+			progress.Message(progressOutput, "", "Loaded image: "+img.Name)
+		}
+		i.logImageEvent(img.Name, "load")
 	}
 	return nil
 }
 
+// reportLoadProgress polls the containerd content store's ingest statuses
+// on a ticker and translates them into the classic `docker load` JSON
+// progress framing, until done is closed. digests restricts this to the
+// blobs belonging to the LoadImage call it was started for, since the
+// content store's ingests are shared daemon-wide.
+func (i *ImageService) reportLoadProgress(ctx context.Context, done <-chan struct{}, out progress.Output, digests *importBlobDigests) {
+	store := i.client.ContentStore()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			statuses, err := store.ListStatuses(ctx)
+			if err != nil {
+				continue
+			}
+			for _, st := range statuses {
+				if !digests.has(st.Expected.String()) {
+					continue
+				}
+				id := stringid.TruncateID(st.Expected.Encoded())
+				progress.Update(out, id, "Loading layer")
+				if st.Total > 0 {
+					progress.UpdateProgress(out, id, "Loading layer", st.Offset, st.Total)
+				}
+			}
+		}
+	}
+}
+
+// importBlobDigests is the set of content-store digests a single LoadImage
+// call is importing, populated by scanImportBlobDigests as the archive
+// streams past. reportLoadProgress consults it so ingest statuses belonging
+// to other, concurrently running imports are ignored.
+type importBlobDigests struct {
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func (d *importBlobDigests) add(digest string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seen == nil {
+		d.seen = make(map[string]struct{})
+	}
+	d.seen[digest] = struct{}{}
+}
+
+func (d *importBlobDigests) has(digest string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.seen[digest]
+	return ok
+}
+
+// blobPathPattern matches an OCI-layout blob entry's path within an image
+// archive, e.g. "blobs/sha256/<hex>".
+var blobPathPattern = regexp.MustCompile(`^blobs/([a-z0-9+._-]+)/([a-f0-9]+)$`)
+
+// scanImportBlobDigests reads r as a tar stream and records the digest of
+// every "blobs/<algorithm>/<hex>" entry it finds into digests, until r is
+// exhausted or returns an error.
+func scanImportBlobDigests(r io.Reader, digests *importBlobDigests) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if m := blobPathPattern.FindStringSubmatch(hdr.Name); m != nil {
+			digests.add(m[1] + ":" + m[2])
+		}
+	}
+}
+
+// pipeTeeReader tees every byte read from r into pw, so a second reader can
+// observe the same stream concurrently. It closes pw, with whatever error r
+// produced (including io.EOF, reported as a clean close), once r is
+// exhausted, so the peer reading from pw's pipe sees the same end-of-stream.
+type pipeTeeReader struct {
+	r  io.Reader
+	pw *io.PipeWriter
+}
+
+func (t *pipeTeeReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if _, werr := t.pw.Write(p[:n]); werr != nil {
+			return n, werr
+		}
+	}
+	if err != nil {
+		if err == io.EOF {
+			t.pw.Close()
+		} else {
+			t.pw.CloseWithError(err)
+		}
+	}
+	return n, err
+}
+
+// exportLayerThreshold pairs a layer descriptor with the cumulative byte
+// count, across all layers of the export ordered by ascending cumulative
+// size, at which that layer's bytes have cleared the output stream.
+type exportLayerThreshold struct {
+	desc       ocispec.Descriptor
+	cumulative int64
+}
+
+// layerExportThresholds walks targets and everything reachable from them
+// that is present in the local content store, and returns the layer blobs
+// in ascending order of cumulative size. reportExportProgress uses these as
+// thresholds to decide when to raise an "export" event for a given layer.
+func (i *ImageService) layerExportThresholds(ctx context.Context, targets ...ocispec.Descriptor) []exportLayerThreshold {
+	if len(targets) == 0 {
+		return nil
+	}
+	store := i.client.ContentStore()
+
+	var (
+		thresholds []exportLayerThreshold
+		cumulative int64
+	)
+	_ = containerdimages.Walk(ctx, containerdimages.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		children, err := containerdimages.Children(ctx, store, desc)
+		if err != nil {
+			if cerrdefs.IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if containerdimages.IsLayerType(desc.MediaType) {
+			if _, err := store.ReaderAt(ctx, desc); err == nil {
+				cumulative += desc.Size
+				thresholds = append(thresholds, exportLayerThreshold{desc: desc, cumulative: cumulative})
+			}
+		}
+		return children, nil
+	}), targets...)
+
+	sort.Slice(thresholds, func(a, b int) bool { return thresholds[a].cumulative < thresholds[b].cumulative })
+	return thresholds
+}
+
+// reportExportProgress polls how many bytes of the export archive have been
+// written and, as counted crosses each threshold's cumulative size, raises
+// an "export" event for that layer so the progress is visible via
+// `docker events`, until done is closed.
+func (i *ImageService) reportExportProgress(done <-chan struct{}, counted *countingWriter, thresholds []exportLayerThreshold) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	next := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			written := atomic.LoadInt64(&counted.written)
+			var crossed []exportLayerThreshold
+			crossed, next = crossedExportThresholds(written, thresholds, next)
+			for _, t := range crossed {
+				i.logImageEvent(t.desc.Digest.String(), "export")
+			}
+			logrus.WithFields(logrus.Fields{
+				"current": written,
+				"total":   sizeOfThresholds(thresholds),
+			}).Debug("image: exporting layer")
+		}
+	}
+}
+
+// crossedExportThresholds returns the thresholds, in order starting at
+// index next, whose cumulative size is now covered by written, along with
+// the index to resume from on the next call.
+func crossedExportThresholds(written int64, thresholds []exportLayerThreshold, next int) ([]exportLayerThreshold, int) {
+	var crossed []exportLayerThreshold
+	for next < len(thresholds) && written >= thresholds[next].cumulative {
+		crossed = append(crossed, thresholds[next])
+		next++
+	}
+	return crossed, next
+}
+
+// sizeOfThresholds returns the total export size represented by thresholds,
+// i.e. the cumulative size of the last layer, or 0 if there are none.
+func sizeOfThresholds(thresholds []exportLayerThreshold) int64 {
+	if len(thresholds) == 0 {
+		return 0
+	}
+	return thresholds[len(thresholds)-1].cumulative
+}
+
+// syncProgressOutput serializes writes to a progress.Output so it can be
+// shared by a polling goroutine and the caller's own code without racing on
+// the underlying stream encoder.
+type syncProgressOutput struct {
+	mu  sync.Mutex
+	out progress.Output
+}
+
+func (s *syncProgressOutput) WriteProgress(p progress.Progress) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.out.WriteProgress(p)
+}
+
+// countingWriter wraps outStream, tracking the number of bytes written
+// through it so export progress can be reported without altering the
+// archive content itself.
+type countingWriter struct {
+	w       io.Writer
+	written int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// logImageEvent raises a Docker image event (load, save, pull, ...) on the
+// events bus so `docker events` reflects operations initiated via
+// containerd, the same as it does for the graphdriver backend.
+func (i *ImageService) logImageEvent(refOrID string, action string) {
+	if i.eventsService == nil {
+		return
+	}
+	i.eventsService.Log(events.Action(action), refOrID, events.ImageEventType)
+}
+
+// applyShortNameResolution re-tags any imported image whose name is an
+// unqualified short name (e.g. a tarball produced by an older client) so
+// that images loaded via `docker load` obey the same short-name resolution
+// policy as resolveImage and image pulls.
+func (i *ImageService) applyShortNameResolution(ctx context.Context, imgs []containerdimages.Image) ([]containerdimages.Image, error) {
+	is := i.client.ImageService()
+	out := make([]containerdimages.Image, 0, len(imgs))
+	for _, img := range imgs {
+		resolved, alias, err := i.ResolveShortName(img.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to resolve short name for loaded image %q", img.Name)
+		}
+		if resolved == img.Name {
+			out = append(out, img)
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{"image": img.Name, "resolved": resolved, "alias": alias}).Info("image: qualified short name of loaded image")
+		renamed := img
+		renamed.Name = resolved
+		created, err := is.Create(ctx, renamed)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to tag loaded image as %q", resolved)
+		}
+		if err := is.Delete(ctx, img.Name); err != nil {
+			logrus.WithError(err).WithField("image", img.Name).Warn("failed to remove unqualified tag of loaded image")
+		}
+		out = append(out, created)
+	}
+	return out, nil
+}
+
 // optForImageExport returns an archive.ExportOpt that should include the image
 // with the provided name in the output archive.
 func (i *ImageService) optForImageExport(ctx context.Context, name string) (archive.ExportOpt, *containerdimages.Image, error) {
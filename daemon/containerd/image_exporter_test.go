@@ -0,0 +1,180 @@
+package containerd
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/progress"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func testThreshold(digestSuffix string, cumulative int64) exportLayerThreshold {
+	return exportLayerThreshold{
+		desc:       ocispec.Descriptor{Digest: digest.Digest("sha256:" + digestSuffix)},
+		cumulative: cumulative,
+	}
+}
+
+func TestCrossedExportThresholds(t *testing.T) {
+	thresholds := []exportLayerThreshold{
+		testThreshold("a", 100),
+		testThreshold("b", 250),
+		testThreshold("c", 400),
+	}
+
+	// Nothing written yet: no thresholds crossed.
+	crossed, next := crossedExportThresholds(0, thresholds, 0)
+	assert.Check(t, is.Len(crossed, 0))
+	assert.Check(t, is.Equal(next, 0))
+
+	// Enough written to cross the first threshold only.
+	crossed, next = crossedExportThresholds(150, thresholds, next)
+	assert.Check(t, is.Len(crossed, 1))
+	assert.Check(t, is.Equal(crossed[0].desc.Digest.String(), "sha256:a"))
+	assert.Check(t, is.Equal(next, 1))
+
+	// A jump that skips straight past the second and third thresholds in
+	// one poll crosses both at once, in order.
+	crossed, next = crossedExportThresholds(500, thresholds, next)
+	assert.Check(t, is.Len(crossed, 2))
+	assert.Check(t, is.Equal(crossed[0].desc.Digest.String(), "sha256:b"))
+	assert.Check(t, is.Equal(crossed[1].desc.Digest.String(), "sha256:c"))
+	assert.Check(t, is.Equal(next, 3))
+
+	// Once exhausted, further polling crosses nothing.
+	crossed, next = crossedExportThresholds(999, thresholds, next)
+	assert.Check(t, is.Len(crossed, 0))
+	assert.Check(t, is.Equal(next, 3))
+}
+
+func TestSizeOfThresholds(t *testing.T) {
+	assert.Check(t, is.Equal(sizeOfThresholds(nil), int64(0)))
+	assert.Check(t, is.Equal(sizeOfThresholds([]exportLayerThreshold{
+		testThreshold("a", 100),
+		testThreshold("b", 250),
+	}), int64(250)))
+}
+
+// fakeProgressOutput records every write it receives so tests can assert on
+// how many actually landed, and optionally detects concurrent calls the way
+// the race detector would if WriteProgress itself weren't synchronized.
+type fakeProgressOutput struct {
+	mu      sync.Mutex
+	entered bool
+	writes  int
+	raced   bool
+}
+
+func (f *fakeProgressOutput) WriteProgress(_ progress.Progress) error {
+	f.mu.Lock()
+	if f.entered {
+		f.raced = true
+	}
+	f.entered = true
+	f.writes++
+	f.mu.Unlock()
+
+	// Stay inside the call for a moment, so an unsynchronized concurrent
+	// caller would observe entered still set.
+	time.Sleep(time.Millisecond)
+
+	f.mu.Lock()
+	f.entered = false
+	f.mu.Unlock()
+	return nil
+}
+
+func TestSyncProgressOutputSerializesWrites(t *testing.T) {
+	fake := &fakeProgressOutput{}
+	out := &syncProgressOutput{out: fake}
+
+	const goroutines = 20
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for n := 0; n < goroutines; n++ {
+		go func() {
+			defer wg.Done()
+			_ = out.WriteProgress(progress.Progress{ID: "layer"})
+		}()
+	}
+	wg.Wait()
+
+	assert.Check(t, !fake.raced, "concurrent writes reached the underlying progress.Output without serialization")
+	assert.Check(t, is.Equal(fake.writes, goroutines))
+}
+
+// buildTar writes a minimal tar archive with one zero-length entry per name.
+func buildTar(t *testing.T, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		assert.NilError(t, tw.WriteHeader(&tar.Header{Name: name, Size: 0}))
+	}
+	assert.NilError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestScanImportBlobDigests(t *testing.T) {
+	data := buildTar(t,
+		"index.json",
+		"manifest.json",
+		"blobs/sha256/"+digest.FromString("a").Encoded(),
+		"blobs/sha256/"+digest.FromString("b").Encoded(),
+	)
+
+	digests := &importBlobDigests{}
+	assert.NilError(t, scanImportBlobDigests(bytes.NewReader(data), digests))
+
+	assert.Check(t, digests.has(digest.FromString("a").String()))
+	assert.Check(t, digests.has(digest.FromString("b").String()))
+	assert.Check(t, !digests.has("index.json"))
+}
+
+func TestPipeTeeReaderCopiesAndClosesOnEOF(t *testing.T) {
+	pr, pw := io.Pipe()
+	tee := &pipeTeeReader{r: bytes.NewReader([]byte("hello")), pw: pw}
+
+	teed := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(pr)
+		teed <- b
+	}()
+
+	out, err := io.ReadAll(tee)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(out), "hello"))
+	assert.Check(t, is.DeepEqual(<-teed, []byte("hello")))
+}
+
+// TestScanImportBlobDigestsUnblocksWhenPipeClosedEarly guards against the
+// goroutine leak that would result if LoadImage returned (e.g. on a
+// malformed archive that i.client.Import rejects without reading it to
+// completion) without ever closing the scan goroutine's pipe.
+func TestScanImportBlobDigestsUnblocksWhenPipeClosedEarly(t *testing.T) {
+	pr, pw := io.Pipe()
+	digests := &importBlobDigests{}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- scanImportBlobDigests(pr, digests)
+	}()
+
+	// Nothing is ever written to pw: this simulates the pipe being closed
+	// before the tar stream it carries was ever fully read.
+	pw.Close()
+
+	select {
+	case err := <-done:
+		assert.NilError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("scanImportBlobDigests did not return after its pipe was closed")
+	}
+}
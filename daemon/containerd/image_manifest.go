@@ -0,0 +1,379 @@
+package containerd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/containerd/containerd/content"
+	cerrdefs "github.com/containerd/containerd/errdefs"
+	containerdimages "github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ManifestEntryOptions carries the per-entry metadata that ManifestAdd (or
+// ManifestAnnotate, to patch it after the fact) attaches to a manifest
+// referenced from an OCI image index.
+type ManifestEntryOptions struct {
+	Platform    *ocispec.Platform
+	Variant     string
+	OSFeatures  []string
+	Annotations map[string]string
+
+	// ArtifactType, if set, overrides the media type recorded for this
+	// entry so it is addressed as an OCI artifact rather than an image
+	// manifest.
+	ArtifactType string
+}
+
+// ManifestPushOptions controls ManifestPush.
+type ManifestPushOptions struct {
+	// AmendOnly, when true, merges listRef's entries into destination's
+	// previously known local index rather than replacing it outright:
+	// entries of destination not present in listRef are preserved. It has
+	// no effect if no image named destination exists locally (e.g. from an
+	// earlier pull); ManifestPush itself doesn't tag destination locally.
+	AmendOnly bool
+}
+
+// ManifestService manages OCI image indexes / Docker manifest lists backed
+// by the containerd content and image stores, on behalf of an ImageService.
+type ManifestService struct {
+	i *ImageService
+}
+
+// Manifests returns the ManifestService for this ImageService.
+func (i *ImageService) Manifests() *ManifestService {
+	return &ManifestService{i: i}
+}
+
+// ManifestCreate assembles a new OCI image index out of the (already
+// locally present) manifests named by refs, writes it to the content store,
+// and tags it as listRef.
+func (s *ManifestService) ManifestCreate(ctx context.Context, listRef string, refs []string) error {
+	idx := ocispec.Index{
+		MediaType:     ocispec.MediaTypeImageIndex,
+		SchemaVersion: 2,
+	}
+
+	for _, ref := range refs {
+		desc, err := s.resolveDescriptor(ctx, ref)
+		if err != nil {
+			return errors.Wrapf(err, "failed to resolve manifest %q", ref)
+		}
+		idx.Manifests = append(idx.Manifests, desc)
+	}
+
+	return s.writeAndTagIndex(ctx, listRef, idx)
+}
+
+// ManifestAdd appends ref as a new entry of the image index tagged as
+// listRef, creating the index if it doesn't exist yet.
+func (s *ManifestService) ManifestAdd(ctx context.Context, listRef string, ref string, opts ManifestEntryOptions) error {
+	idx, err := s.getOrInitIndex(ctx, listRef)
+	if err != nil {
+		return err
+	}
+
+	desc, err := s.resolveDescriptor(ctx, ref)
+	if err != nil {
+		return errors.Wrapf(err, "failed to resolve manifest %q", ref)
+	}
+	applyEntryOptions(&desc, opts)
+
+	idx.Manifests = append(idx.Manifests, desc)
+	return s.writeAndTagIndex(ctx, listRef, idx)
+}
+
+// ManifestAnnotate patches the entry identified by dgst within the image
+// index tagged as listRef.
+func (s *ManifestService) ManifestAnnotate(ctx context.Context, listRef string, dgst digest.Digest, opts ManifestEntryOptions) error {
+	idx, err := s.getIndex(ctx, listRef)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for i, m := range idx.Manifests {
+		if m.Digest != dgst {
+			continue
+		}
+		found = true
+		applyEntryOptions(&idx.Manifests[i], opts)
+	}
+	if !found {
+		return errdefs.NotFound(errors.Errorf("no entry with digest %s in %q", dgst, listRef))
+	}
+
+	return s.writeAndTagIndex(ctx, listRef, idx)
+}
+
+// ManifestRemove drops the entry identified by dgst from the image index
+// tagged as listRef.
+func (s *ManifestService) ManifestRemove(ctx context.Context, listRef string, dgst digest.Digest) error {
+	idx, err := s.getIndex(ctx, listRef)
+	if err != nil {
+		return err
+	}
+
+	kept := idx.Manifests[:0]
+	for _, m := range idx.Manifests {
+		if m.Digest != dgst {
+			kept = append(kept, m)
+		}
+	}
+	if len(kept) == len(idx.Manifests) {
+		return errdefs.NotFound(errors.Errorf("no entry with digest %s in %q", dgst, listRef))
+	}
+	idx.Manifests = kept
+
+	return s.writeAndTagIndex(ctx, listRef, idx)
+}
+
+// ManifestInspect returns the raw OCI index tagged as listRef.
+func (s *ManifestService) ManifestInspect(ctx context.Context, listRef string) (ocispec.Index, error) {
+	return s.getIndex(ctx, listRef)
+}
+
+// ManifestPush pushes the image index tagged as listRef, plus any entry
+// manifests and blobs that are present in the local content store, to
+// destination.
+func (s *ManifestService) ManifestPush(ctx context.Context, listRef string, destination string, opts ManifestPushOptions) (ocispec.Descriptor, error) {
+	img, err := s.i.resolveImage(ctx, listRef, nil)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if !containerdimages.IsIndexType(img.Target.MediaType) {
+		return ocispec.Descriptor{}, errdefs.InvalidParameter(errors.Errorf("%q is not a manifest list", listRef))
+	}
+
+	dest, err := reference.ParseNormalizedNamed(destination)
+	if err != nil {
+		return ocispec.Descriptor{}, errdefs.InvalidParameter(err)
+	}
+	dest = reference.TagNameOnly(dest)
+
+	target := img.Target
+	if opts.AmendOnly {
+		// Merge in any entries of the destination's previously known local
+		// index (e.g. from an earlier pull under that name) that
+		// aren't present in listRef, instead of overwriting them. If we've
+		// never seen destination locally, there's nothing to amend and this
+		// is just a regular push.
+		//
+		// The merged index is written as a throwaway blob and pushed
+		// directly: listRef itself is never rewritten, so the caller's own
+		// tag keeps meaning exactly what they tagged, not whatever
+		// destination happened to hold locally.
+		destIdx, err := s.getIndex(ctx, dest.String())
+		if err != nil && !cerrdefs.IsNotFound(err) && !errdefs.IsNotFound(err) {
+			return ocispec.Descriptor{}, err
+		}
+		if err == nil {
+			idx, err := s.getIndex(ctx, listRef)
+			if err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			idx.Manifests = mergeManifestEntries(destIdx.Manifests, idx.Manifests)
+
+			target, err = s.writeIndexBlob(ctx, idx)
+			if err != nil {
+				return ocispec.Descriptor{}, err
+			}
+		}
+	}
+
+	// The pusher always checks the destination for each blob/manifest
+	// before uploading it, so blobs the registry already has are skipped
+	// either way; AmendOnly's effect is entirely in the merge above.
+	if err := s.i.client.Push(ctx, dest.String(), target); err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(err, "failed to push manifest list to %s", dest.String())
+	}
+
+	logrus.WithFields(logrus.Fields{"ref": listRef, "destination": dest.String()}).Info("image: pushed manifest list")
+	return target, nil
+}
+
+// mergeManifestEntries combines base and overlay into a single list of
+// manifest entries, keyed by platform (or digest, for entries without a
+// platform): an entry in overlay always wins over one for the same key in
+// base, and entries only present in base are preserved.
+func mergeManifestEntries(base, overlay []ocispec.Descriptor) []ocispec.Descriptor {
+	key := func(d ocispec.Descriptor) string {
+		if d.Platform != nil {
+			return platforms.Format(*d.Platform)
+		}
+		return d.Digest.String()
+	}
+
+	merged := make([]ocispec.Descriptor, 0, len(base)+len(overlay))
+	seen := make(map[string]bool, len(overlay))
+	for _, d := range overlay {
+		seen[key(d)] = true
+		merged = append(merged, d)
+	}
+	for _, d := range base {
+		if !seen[key(d)] {
+			merged = append(merged, d)
+		}
+	}
+	return merged
+}
+
+// resolveDescriptor resolves ref to a descriptor suitable for inclusion in
+// an image index, filling in a default Platform for manifests that don't
+// carry one of their own (single-platform manifests referenced directly,
+// rather than through an index).
+func (s *ManifestService) resolveDescriptor(ctx context.Context, ref string) (ocispec.Descriptor, error) {
+	img, err := s.i.resolveImage(ctx, ref, nil)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	desc := img.Target
+	if desc.Platform == nil && containerdimages.IsManifestType(desc.MediaType) {
+		store := s.i.client.ContentStore()
+		ps, err := containerdimages.Platforms(ctx, store, desc)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		if len(ps) > 0 {
+			sort.Slice(ps, func(a, b int) bool {
+				return allPlatformsWithPreference(platforms.Default()).Less(ps[a], ps[b])
+			})
+			desc.Platform = &ps[0]
+		} else {
+			def := platforms.DefaultSpec()
+			desc.Platform = &def
+		}
+	}
+	return desc, nil
+}
+
+// applyEntryOptions overlays the fields set in opts onto desc.
+func applyEntryOptions(desc *ocispec.Descriptor, opts ManifestEntryOptions) {
+	if opts.ArtifactType != "" {
+		desc.MediaType = opts.ArtifactType
+	}
+	if opts.Platform != nil {
+		// Copy rather than alias opts.Platform: the Variant/OSFeatures
+		// overlay below mutates desc.Platform in place, and opts.Platform
+		// is owned by the caller.
+		p := *opts.Platform
+		desc.Platform = &p
+	}
+	if opts.Variant != "" || len(opts.OSFeatures) > 0 {
+		if desc.Platform == nil {
+			desc.Platform = &ocispec.Platform{}
+		}
+		if opts.Variant != "" {
+			desc.Platform.Variant = opts.Variant
+		}
+		if len(opts.OSFeatures) > 0 {
+			desc.Platform.OSFeatures = opts.OSFeatures
+		}
+	}
+	if len(opts.Annotations) > 0 {
+		if desc.Annotations == nil {
+			desc.Annotations = make(map[string]string, len(opts.Annotations))
+		}
+		for k, v := range opts.Annotations {
+			desc.Annotations[k] = v
+		}
+	}
+}
+
+// getIndex loads and decodes the OCI index tagged as listRef; it returns a
+// NotFound error if listRef doesn't exist, or an InvalidParameter error if
+// it exists but isn't an index.
+func (s *ManifestService) getIndex(ctx context.Context, listRef string) (ocispec.Index, error) {
+	img, err := s.i.resolveImage(ctx, listRef, nil)
+	if err != nil {
+		return ocispec.Index{}, err
+	}
+	if !containerdimages.IsIndexType(img.Target.MediaType) {
+		return ocispec.Index{}, errdefs.InvalidParameter(errors.Errorf("%q is not a manifest list", listRef))
+	}
+
+	blob, err := content.ReadBlob(ctx, s.i.client.ContentStore(), img.Target)
+	if err != nil {
+		return ocispec.Index{}, errors.Wrap(err, "failed to read manifest list")
+	}
+
+	var idx ocispec.Index
+	if err := json.Unmarshal(blob, &idx); err != nil {
+		return ocispec.Index{}, errors.Wrap(err, "failed to decode manifest list")
+	}
+	return idx, nil
+}
+
+// getOrInitIndex is like getIndex, but returns a fresh, empty index instead
+// of a NotFound error when listRef doesn't exist yet.
+func (s *ManifestService) getOrInitIndex(ctx context.Context, listRef string) (ocispec.Index, error) {
+	idx, err := s.getIndex(ctx, listRef)
+	if err != nil {
+		if cerrdefs.IsNotFound(err) || errdefs.IsNotFound(err) {
+			return ocispec.Index{MediaType: ocispec.MediaTypeImageIndex, SchemaVersion: 2}, nil
+		}
+		return ocispec.Index{}, err
+	}
+	return idx, nil
+}
+
+// writeIndexBlob marshals idx and writes it to the content store as an
+// anonymous blob, without tagging it as any image, and returns its
+// descriptor.
+func (s *ManifestService) writeIndexBlob(ctx context.Context, idx ocispec.Index) (ocispec.Descriptor, error) {
+	payload, err := json.Marshal(idx)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	dgst := digest.FromBytes(payload)
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Digest:    dgst,
+		Size:      int64(len(payload)),
+	}
+
+	cs := s.i.client.ContentStore()
+	if err := content.WriteBlob(ctx, cs, dgst.String(), bytes.NewReader(payload), desc); err != nil {
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to write manifest list to content store")
+	}
+	return desc, nil
+}
+
+// writeAndTagIndex writes idx to the content store and tags it as listRef,
+// overwriting any existing image with that name.
+func (s *ManifestService) writeAndTagIndex(ctx context.Context, listRef string, idx ocispec.Index) error {
+	named, err := reference.ParseNormalizedNamed(listRef)
+	if err != nil {
+		return errdefs.InvalidParameter(err)
+	}
+	named = reference.TagNameOnly(named)
+
+	desc, err := s.writeIndexBlob(ctx, idx)
+	if err != nil {
+		return err
+	}
+
+	is := s.i.client.ImageService()
+	newImg := containerdimages.Image{Name: named.String(), Target: desc}
+	if _, err := is.Create(ctx, newImg); err != nil {
+		if !cerrdefs.IsAlreadyExists(err) {
+			return errors.Wrap(err, "failed to tag manifest list")
+		}
+		if _, err := is.Update(ctx, newImg); err != nil {
+			return errors.Wrap(err, "failed to retag manifest list")
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{"ref": named.String(), "digest": desc.Digest}).Info("image: wrote manifest list")
+	return nil
+}
@@ -0,0 +1,70 @@
+package containerd
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestApplyEntryOptionsDoesNotAliasCallerPlatform(t *testing.T) {
+	callerPlatform := &ocispec.Platform{OS: "linux", Architecture: "arm64"}
+	desc := ocispec.Descriptor{}
+
+	applyEntryOptions(&desc, ManifestEntryOptions{
+		Platform: callerPlatform,
+		Variant:  "v8",
+	})
+
+	assert.Check(t, is.Equal(desc.Platform.Variant, "v8"))
+	assert.Check(t, is.Equal(callerPlatform.Variant, ""), "applyEntryOptions must not mutate the caller's Platform")
+}
+
+func TestApplyEntryOptionsOverlay(t *testing.T) {
+	desc := ocispec.Descriptor{
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Annotations: map[string]string{"existing": "value"},
+	}
+
+	applyEntryOptions(&desc, ManifestEntryOptions{
+		ArtifactType: "application/vnd.example.artifact",
+		OSFeatures:   []string{"win32k"},
+		Annotations:  map[string]string{"added": "value"},
+	})
+
+	assert.Check(t, is.Equal(desc.MediaType, "application/vnd.example.artifact"))
+	assert.Check(t, is.DeepEqual(desc.Platform.OSFeatures, []string{"win32k"}))
+	assert.Check(t, is.Equal(desc.Annotations["existing"], "value"))
+	assert.Check(t, is.Equal(desc.Annotations["added"], "value"))
+}
+
+func TestMergeManifestEntriesOverlayWins(t *testing.T) {
+	base := []ocispec.Descriptor{
+		{Digest: digest.Digest("sha256:base-amd64"), Platform: &ocispec.Platform{OS: "linux", Architecture: "amd64"}},
+		{Digest: digest.Digest("sha256:base-arm64"), Platform: &ocispec.Platform{OS: "linux", Architecture: "arm64"}},
+	}
+	overlay := []ocispec.Descriptor{
+		{Digest: digest.Digest("sha256:new-amd64"), Platform: &ocispec.Platform{OS: "linux", Architecture: "amd64"}},
+	}
+
+	merged := mergeManifestEntries(base, overlay)
+
+	assert.Check(t, is.Len(merged, 2))
+	assert.Check(t, is.Equal(merged[0].Digest, digest.Digest("sha256:new-amd64")), "overlay entry should win for the shared platform")
+	assert.Check(t, is.Equal(merged[1].Digest, digest.Digest("sha256:base-arm64")), "base entry should be preserved when overlay has no entry for that platform")
+}
+
+func TestMergeManifestEntriesByDigestWithoutPlatform(t *testing.T) {
+	base := []ocispec.Descriptor{
+		{Digest: digest.Digest("sha256:aaaa")},
+	}
+	overlay := []ocispec.Descriptor{
+		{Digest: digest.Digest("sha256:bbbb")},
+	}
+
+	merged := mergeManifestEntries(base, overlay)
+
+	assert.Check(t, is.Len(merged, 2))
+}
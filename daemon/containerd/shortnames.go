@@ -0,0 +1,198 @@
+package containerd
+
+import (
+	"strings"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ShortNameMode controls how an unqualified ("short") image reference, such
+// as nginx, is expanded into a fully qualified one.
+type ShortNameMode string
+
+const (
+	// ShortNameModePermissive resolves a short name that has no configured
+	// alias against Docker Hub, matching the historical default behavior of
+	// the daemon.
+	ShortNameModePermissive ShortNameMode = "permissive"
+
+	// ShortNameModeEnforcing only resolves a short name if it matches a
+	// configured alias, or against the configured unqualified-search
+	// registry; any other short name is rejected.
+	ShortNameModeEnforcing ShortNameMode = "enforcing"
+
+	// ShortNameModeAliasesOnly resolves a short name only if an explicit
+	// alias has been configured for it; any other short name is rejected,
+	// including ones that would otherwise match an unqualified-search
+	// registry.
+	ShortNameModeAliasesOnly ShortNameMode = "aliases-only"
+)
+
+// ShortNameConfig is the short-name resolution policy, read from the
+// "unqualified-search-registries" and "short-name-aliases" fields of
+// daemon.json. It is shared by resolveImage, LoadImage, and image pulls so
+// that `docker run nginx`, `docker pull nginx`, and a Compose file all obey
+// the same policy.
+type ShortNameConfig struct {
+	// Mode selects the resolution policy. The zero value behaves as
+	// ShortNameModePermissive.
+	Mode ShortNameMode
+
+	// SearchRegistry is the single registry an unqualified name is
+	// resolved against in ShortNameModeEnforcing. daemon.json's
+	// "unqualified-search-registries" is an array, for parity with the
+	// containers/image registries.conf convention it's modeled on, but
+	// this resolver doesn't implement ordered, try-the-next-one-on-failure
+	// fallback across multiple registries; ShortNameConfigFromRaw takes
+	// only the first configured entry.
+	SearchRegistry string
+
+	// Aliases maps a short name (e.g. "nginx") to a fully qualified
+	// reference (e.g. "docker.io/library/nginx"). Aliases are consulted
+	// before SearchRegistry, and are the only source of resolution in
+	// ShortNameModeAliasesOnly.
+	Aliases map[string]string
+}
+
+// shortNameResolver expands unqualified image references according to a
+// ShortNameConfig, and reports which alias or registry it used so callers
+// can log/audit that choice.
+type shortNameResolver struct {
+	cfg ShortNameConfig
+}
+
+func newShortNameResolver(cfg ShortNameConfig) *shortNameResolver {
+	if cfg.Mode == "" {
+		cfg.Mode = ShortNameModePermissive
+	}
+	return &shortNameResolver{cfg: cfg}
+}
+
+// defaultShortNameResolver is used by resolveImage, LoadImage, and pulls
+// whenever the daemon hasn't been given an explicit ShortNameConfig (e.g.
+// daemon.json carries none of the short-name fields). It reproduces the
+// historical permissive behavior, so it changes nothing for daemons that
+// don't opt in.
+var defaultShortNameResolver = newShortNameResolver(ShortNameConfig{Mode: ShortNameModePermissive})
+
+// SetShortNameConfig installs cfg as this ImageService's short-name
+// resolution policy. resolveImage, LoadImage, and image pulls all go
+// through shortNameResolverFor, so they immediately pick up whatever
+// policy was configured.
+//
+// Nothing in the daemon calls this yet: wiring daemon.json's
+// short-name-resolution fields (config.ShortNameResolutionConfig, via
+// ShortNameConfigFromRaw below) through to daemon start-up is left for a
+// follow-up change. Until then, every ImageService runs with
+// defaultShortNameResolver.
+func (i *ImageService) SetShortNameConfig(cfg ShortNameConfig) {
+	i.shortNameResolver = newShortNameResolver(cfg)
+}
+
+// shortNameResolverFor returns i's configured resolver, or
+// defaultShortNameResolver if none has been set. resolveImage, LoadImage,
+// and image pulls (daemon/containerd/pull.go, outside this package's scope
+// in this change) all call through this single accessor so they can never
+// apply divergent policies.
+func (i *ImageService) shortNameResolverFor() *shortNameResolver {
+	if i.shortNameResolver != nil {
+		return i.shortNameResolver
+	}
+	return defaultShortNameResolver
+}
+
+// resolve rewrites refOrID into a fully qualified reference string if it is
+// unqualified (carries no explicit registry domain), according to the
+// configured short-name resolution policy. It returns the (possibly
+// unchanged) reference string, and the alias or registry that was used to
+// qualify it ("" if refOrID was already qualified).
+//
+// Matching is always done on the full repository path (e.g. "library/nginx"
+// or "myfoo"), never on a substring or prefix of it, so a short name such as
+// "foo" can never be satisfied by an alias or search registry configured for
+// "myfoo".
+func (r *shortNameResolver) resolve(refOrID string) (string, string, error) {
+	if hasExplicitDomain(refOrID) {
+		return refOrID, "", nil
+	}
+
+	remainder := trimTagOrDigest(refOrID)
+	suffix := strings.TrimPrefix(refOrID, remainder)
+
+	if alias, ok := r.cfg.Aliases[remainder]; ok {
+		logrus.WithFields(logrus.Fields{"short-name": remainder, "alias": alias}).Info("image: resolved short name using configured alias")
+		return alias + suffix, alias, nil
+	}
+
+	switch r.cfg.Mode {
+	case ShortNameModeAliasesOnly:
+		return "", "", errdefs.InvalidParameter(errors.Errorf("short name %q requires an explicit alias (aliases-only mode)", remainder))
+	case ShortNameModeEnforcing:
+		if r.cfg.SearchRegistry == "" {
+			return "", "", errdefs.InvalidParameter(errors.Errorf("short name %q did not match any unqualified-search registry", remainder))
+		}
+		registry := r.cfg.SearchRegistry
+		logrus.WithFields(logrus.Fields{"short-name": remainder, "registry": registry}).Info("image: resolved short name using unqualified-search registry")
+		return registry + "/" + remainder + suffix, registry, nil
+	default: // ShortNameModePermissive
+		return refOrID, "", nil
+	}
+}
+
+// ShortNameConfigFromRaw builds a ShortNameConfig from the raw fields of
+// daemon.json's "short-name-resolution" / "unqualified-search-registries" /
+// "short-name-aliases", without this package having to depend on
+// daemon/config. Once daemon start-up is wired to call this and then
+// ImageService.SetShortNameConfig with the result (see that method's doc
+// comment), this is how it will do so; nothing calls it yet.
+//
+// searchRegistries is a list, matching the shape of daemon.json's
+// "unqualified-search-registries", but only its first entry is used: see
+// ShortNameConfig.SearchRegistry.
+func ShortNameConfigFromRaw(mode string, searchRegistries []string, aliases map[string]string) ShortNameConfig {
+	var searchRegistry string
+	if len(searchRegistries) > 0 {
+		searchRegistry = searchRegistries[0]
+	}
+	return ShortNameConfig{
+		Mode:           ShortNameMode(mode),
+		SearchRegistry: searchRegistry,
+		Aliases:        aliases,
+	}
+}
+
+// ResolveShortName is the single entry point resolveImage, LoadImage, and
+// image pulls all call to apply the configured short-name resolution
+// policy to a possibly-unqualified reference string.
+func (i *ImageService) ResolveShortName(refOrID string) (resolved string, usedAliasOrRegistry string, err error) {
+	return i.shortNameResolverFor().resolve(refOrID)
+}
+
+// hasExplicitDomain reports whether the repository portion of name carries
+// an explicit registry domain (contains a "." or ":", or is "localhost"),
+// following the same rule distribution/reference uses to decide whether a
+// name needs to be qualified against the default registry.
+func hasExplicitDomain(name string) bool {
+	i := strings.IndexRune(name, '/')
+	if i == -1 {
+		return false
+	}
+	host := name[:i]
+	return strings.ContainsAny(host, ".:") || host == "localhost"
+}
+
+// trimTagOrDigest strips a trailing ":tag" or "@digest" suffix from ref,
+// returning the bare repository path.
+func trimTagOrDigest(ref string) string {
+	if i := strings.IndexRune(ref, '@'); i != -1 {
+		ref = ref[:i]
+	}
+	if i := strings.LastIndexByte(ref, ':'); i != -1 {
+		if j := strings.LastIndexByte(ref, '/'); j < i {
+			ref = ref[:i]
+		}
+	}
+	return ref
+}
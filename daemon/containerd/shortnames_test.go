@@ -0,0 +1,97 @@
+package containerd
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestShortNameResolverAlreadyQualified(t *testing.T) {
+	r := newShortNameResolver(ShortNameConfig{Mode: ShortNameModeAliasesOnly})
+
+	resolved, used, err := r.resolve("docker.io/library/nginx:latest")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(resolved, "docker.io/library/nginx:latest"))
+	assert.Check(t, is.Equal(used, ""))
+}
+
+func TestShortNameResolverPermissive(t *testing.T) {
+	r := newShortNameResolver(ShortNameConfig{Mode: ShortNameModePermissive})
+
+	resolved, used, err := r.resolve("nginx:latest")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(resolved, "nginx:latest"))
+	assert.Check(t, is.Equal(used, ""))
+}
+
+func TestShortNameResolverAliasesOnly(t *testing.T) {
+	r := newShortNameResolver(ShortNameConfig{
+		Mode:    ShortNameModeAliasesOnly,
+		Aliases: map[string]string{"nginx": "docker.io/library/nginx"},
+	})
+
+	resolved, used, err := r.resolve("nginx:latest")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(resolved, "docker.io/library/nginx:latest"))
+	assert.Check(t, is.Equal(used, "docker.io/library/nginx"))
+
+	_, _, err = r.resolve("redis:latest")
+	assert.ErrorContains(t, err, "requires an explicit alias")
+}
+
+func TestShortNameResolverEnforcingSearchRegistry(t *testing.T) {
+	r := newShortNameResolver(ShortNameConfig{
+		Mode:           ShortNameModeEnforcing,
+		SearchRegistry: "mirror.example.com",
+	})
+
+	resolved, used, err := r.resolve("nginx:latest")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(resolved, "mirror.example.com/nginx:latest"))
+	assert.Check(t, is.Equal(used, "mirror.example.com"))
+}
+
+func TestShortNameResolverEnforcingRejectsUnmatched(t *testing.T) {
+	r := newShortNameResolver(ShortNameConfig{Mode: ShortNameModeEnforcing})
+
+	_, _, err := r.resolve("nginx")
+	assert.ErrorContains(t, err, "did not match any unqualified-search registry")
+}
+
+// TestShortNameConfigFromRawUsesFirstSearchRegistryOnly documents that, with
+// multiple unqualified-search registries configured in daemon.json, only the
+// first is carried into ShortNameConfig: there is no fallback to later
+// entries today.
+func TestShortNameConfigFromRawUsesFirstSearchRegistryOnly(t *testing.T) {
+	cfg := ShortNameConfigFromRaw("enforcing", []string{"mirror.example.com", "other.example.com"}, nil)
+
+	assert.Check(t, is.Equal(cfg.SearchRegistry, "mirror.example.com"))
+}
+
+// TestShortNameResolverRepositoryBoundary verifies that alias matching is
+// always an exact lookup on the full repository path, never substring or
+// prefix matching: an alias configured for "myfoo" must never be applied to
+// a short name "foo" just because "foo" is a prefix of "myfoo".
+func TestShortNameResolverRepositoryBoundary(t *testing.T) {
+	r := newShortNameResolver(ShortNameConfig{
+		Mode:    ShortNameModeAliasesOnly,
+		Aliases: map[string]string{"myfoo": "example.com/myfoo"},
+	})
+
+	_, _, err := r.resolve("foo")
+	assert.ErrorContains(t, err, "requires an explicit alias")
+}
+
+func TestShortNameResolverEnforcingWithDigest(t *testing.T) {
+	r := newShortNameResolver(ShortNameConfig{
+		Mode:           ShortNameModeEnforcing,
+		SearchRegistry: "mirror.example.com",
+	})
+
+	const digest = "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	resolved, used, err := r.resolve("nginx@" + digest)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(resolved, "mirror.example.com/nginx@"+digest))
+	assert.Check(t, is.Equal(used, "mirror.example.com"))
+}